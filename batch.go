@@ -0,0 +1,140 @@
+package cookieryapi
+
+//
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Bulk site operations for seeding or pruning a large site list in one
+// round trip, instead of one Put/Delete per HTTP request.
+
+import (
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// maxBatchSize mirrors the Datastore limit of 500 entities per
+// PutMulti/DeleteMulti/transaction call.
+const maxBatchSize = 500
+
+// batchCreateSites validates each site, then Puts the valid ones together
+// in a single transaction (they all share the defaultSiteList ancestor, so
+// this stays within one entity group). Invalid sites are skipped and
+// reported in errs by their index in sites; ids[i] is left at 0 for any
+// index that didn't make it into the transaction.
+func batchCreateSites(c appengine.Context, sites []Site, owner string) (ids []int64, errs map[int]string, err error) {
+	ids = make([]int64, len(sites))
+	errs = map[int]string{}
+
+	valid := make([]Site, 0, len(sites))
+	validIdx := make([]int, 0, len(sites))
+	for i, s := range sites {
+		if s.Name == "" {
+			errs[i] = "name is required"
+			continue
+		}
+		s.Id = 0
+		s.Created = time.Now()
+		s.Owner = owner
+		valid = append(valid, s)
+		validIdx = append(validIdx, i)
+	}
+	if len(valid) == 0 {
+		return ids, errs, nil
+	}
+
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		keys := make([]*datastore.Key, len(valid))
+		for i := range valid {
+			keys[i] = datastore.NewIncompleteKey(tc, "Site", defaultSiteList(tc))
+		}
+		putKeys, err := datastore.PutMulti(tc, keys, valid)
+		if err != nil {
+			return err
+		}
+		for i, k := range putKeys {
+			ids[validIdx[i]] = k.IntID()
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		for _, i := range validIdx {
+			ids[i] = 0
+			errs[i] = err.Error()
+		}
+		return ids, errs, nil
+	}
+
+	categoryKeys := []string{}
+	for _, s := range valid {
+		categoryKeys = append(categoryKeys, s.CategoryID...)
+	}
+	invalidateSiteCaches(c, categoryKeys)
+	return ids, errs, nil
+}
+
+// batchDeleteSites deletes every id the caller owns, skipping (and
+// reporting in errs, keyed by index into ids) any id that doesn't exist or
+// belongs to someone else. It returns the ids actually deleted.
+func batchDeleteSites(c appengine.Context, ids []int64, owner string) (deleted []int64, errs map[int]string, err error) {
+	errs = map[int]string{}
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(c, "Site", "", id, defaultSiteList(c))
+	}
+
+	existing := make([]Site, len(ids))
+	getErr := datastore.GetMulti(c, keys, existing)
+	merr, isMulti := getErr.(appengine.MultiError)
+	if getErr != nil && !isMulti {
+		return nil, nil, getErr
+	}
+
+	toDelete := make([]*datastore.Key, 0, len(ids))
+	toDeleteIdx := make([]int, 0, len(ids))
+	for i := range ids {
+		if isMulti && merr[i] != nil {
+			errs[i] = merr[i].Error()
+			continue
+		}
+		if existing[i].Owner != "" && existing[i].Owner != owner {
+			errs[i] = "forbidden: not the owner of this site"
+			continue
+		}
+		toDelete = append(toDelete, keys[i])
+		toDeleteIdx = append(toDeleteIdx, i)
+	}
+
+	deleted = make([]int64, 0, len(toDeleteIdx))
+	categoryKeys := []string{}
+	if len(toDelete) > 0 {
+		delErr := datastore.DeleteMulti(c, toDelete)
+		dmerr, isDeleteMulti := delErr.(appengine.MultiError)
+		if delErr != nil && !isDeleteMulti {
+			return nil, nil, delErr
+		}
+		for i, idx := range toDeleteIdx {
+			if isDeleteMulti && dmerr[i] != nil {
+				errs[idx] = dmerr[i].Error()
+				continue
+			}
+			deleted = append(deleted, ids[idx])
+			categoryKeys = append(categoryKeys, existing[idx].CategoryID...)
+		}
+	}
+	invalidateSiteCaches(c, categoryKeys)
+	return deleted, errs, nil
+}
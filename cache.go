@@ -0,0 +1,116 @@
+package cookieryapi
+
+//
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Site listings are read far more often than they're written, so
+// getAllSites and getCategorySites are served from memcache, keyed
+// "sites:all" and "sites:cat:<encoded category key>". Every write path
+// (Site.save, Site.delete, the batch create/delete endpoints) invalidates
+// the caches it could have affected.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+const cacheKeyAllSites = "sites:all"
+
+func cacheKeyForCategory(key *datastore.Key) string {
+	return cacheKeyForCategoryEncoded(key.Encode())
+}
+
+// cacheKeyForCategoryEncoded builds the same cache key as
+// cacheKeyForCategory, for callers that only have the already-encoded key
+// string (e.g. Site.CategoryID).
+func cacheKeyForCategoryEncoded(encoded string) string {
+	return "sites:cat:" + encoded
+}
+
+// cachedSites serves key from memcache on a hit, otherwise calls load and
+// populates the cache with its result. nocache skips memcache entirely, for
+// debugging a suspected stale entry.
+func cachedSites(c appengine.Context, key string, nocache bool, load func() ([]Site, error)) ([]Site, error) {
+	if !nocache {
+		var sites []Site
+		_, err := memcache.JSON.Get(c, key, &sites)
+		if err == nil {
+			recordCacheResult(c, key, true)
+			return sites, nil
+		}
+		if err != memcache.ErrCacheMiss {
+			c.Warningf("cache: error reading %s: %v", key, err)
+		}
+		recordCacheResult(c, key, false)
+	}
+
+	sites, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if !nocache {
+		item := &memcache.Item{Key: key, Object: sites}
+		if err := memcache.JSON.Set(c, item); err != nil {
+			c.Warningf("cache: error writing %s: %v", key, err)
+		}
+	}
+	return sites, nil
+}
+
+// recordCacheResult keeps a running hit/miss counter in memcache (reset
+// whenever memcache itself is flushed) and logs each lookup, so cache
+// effectiveness can be read straight from the App Engine log viewer.
+func recordCacheResult(c appengine.Context, key string, hit bool) {
+	counter, outcome := "cache:misses", "miss"
+	if hit {
+		counter, outcome = "cache:hits", "hit"
+	}
+	if _, err := memcache.Increment(c, counter, 1, 0); err != nil {
+		c.Warningf("cache: failed to update %s counter: %v", counter, err)
+	}
+	c.Infof("cache %s: %s", outcome, key)
+}
+
+// invalidateSiteCaches drops "sites:all" and the per-category caches for
+// the given encoded category keys (as stored in Site.CategoryID), plus
+// every ancestor of those categories: queryCategorySites aggregates a
+// category's listing with all of its descendants', so a site tagged only
+// with a child category also staled its parents' cached listings. Call it
+// whenever a Site is created, updated or removed.
+func invalidateSiteCaches(c appengine.Context, categoryKeys []string) {
+	keys := []string{cacheKeyAllSites}
+	seen := map[string]bool{}
+	for _, encoded := range categoryKeys {
+		ancestors, err := ancestorCategoryKeys(c, encoded)
+		if err != nil {
+			c.Warningf("cache: error walking ancestors of %s: %v", encoded, err)
+			ancestors = []string{encoded}
+		}
+		for _, a := range ancestors {
+			if seen[a] {
+				continue
+			}
+			seen[a] = true
+			keys = append(keys, cacheKeyForCategoryEncoded(a))
+		}
+	}
+	for _, k := range keys {
+		if err := memcache.Delete(c, k); err != nil && err != memcache.ErrCacheMiss {
+			c.Warningf("cache: error invalidating %s: %v", k, err)
+		}
+	}
+}
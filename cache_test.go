@@ -0,0 +1,129 @@
+package cookieryapi
+
+//
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+import (
+	"testing"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+)
+
+// loggedInContext returns an appengine.Context backed by a fresh aetest
+// instance, with a signed-in user so Site.save doesn't reject the write.
+func loggedInContext(t *testing.T) appengine.Context {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatalf("aetest.NewInstance: %v", err)
+	}
+	req, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("inst.NewRequest: %v", err)
+	}
+	req.Header.Set("X-AppEngine-User-Email", "owner@example.com")
+	req.Header.Set("X-AppEngine-User-Id", "1")
+	t.Cleanup(func() { inst.Close() })
+	return appengine.NewContext(req)
+}
+
+// TestInvalidateSiteCachesBustsCategoryCache guards against the bug where
+// invalidateSiteCaches deleted the raw encoded category key instead of
+// cacheKeyForCategory(key), leaving getCategorySites serving a stale
+// listing forever after the first write to a categorized site.
+func TestInvalidateSiteCachesBustsCategoryCache(t *testing.T) {
+	c := loggedInContext(t)
+
+	cat := &Category{Name: "tracking"}
+	if _, err := cat.save(c); err != nil {
+		t.Fatalf("cat.save: %v", err)
+	}
+	catKey, err := datastore.DecodeKey(cat.Key)
+	if err != nil {
+		t.Fatalf("datastore.DecodeKey: %v", err)
+	}
+
+	first := &Site{Name: "one", CategoryID: []string{cat.Key}}
+	if _, err := first.save(c); err != nil {
+		t.Fatalf("first.save: %v", err)
+	}
+
+	// Populate the per-category cache entry.
+	sites, err := getCategorySites(c, catKey, false)
+	if err != nil {
+		t.Fatalf("getCategorySites: %v", err)
+	}
+	if len(sites) != 1 {
+		t.Fatalf("got %d sites before second save, want 1", len(sites))
+	}
+
+	second := &Site{Name: "two", CategoryID: []string{cat.Key}}
+	if _, err := second.save(c); err != nil {
+		t.Fatalf("second.save: %v", err)
+	}
+
+	sites, err = getCategorySites(c, catKey, false)
+	if err != nil {
+		t.Fatalf("getCategorySites after invalidation: %v", err)
+	}
+	if len(sites) != 2 {
+		t.Fatalf("got %d sites after second save, want 2 (cache not invalidated)", len(sites))
+	}
+}
+
+// TestInvalidateSiteCachesBustsAncestorCategoryCache guards against the
+// bug where invalidateSiteCaches only busted the cache for a site's own
+// categories, never its ancestors' — even though queryCategorySites
+// aggregates a parent's listing from all of its descendants.
+func TestInvalidateSiteCachesBustsAncestorCategoryCache(t *testing.T) {
+	c := loggedInContext(t)
+
+	parent := &Category{Name: "parent"}
+	if _, err := parent.save(c); err != nil {
+		t.Fatalf("parent.save: %v", err)
+	}
+	parentKey, err := datastore.DecodeKey(parent.Key)
+	if err != nil {
+		t.Fatalf("datastore.DecodeKey: %v", err)
+	}
+	child := &Category{Name: "child", ParentID: parent.Key}
+	if _, err := child.save(c); err != nil {
+		t.Fatalf("child.save: %v", err)
+	}
+
+	// Populate the parent's aggregated cache entry before it has any sites.
+	sites, err := getCategorySites(c, parentKey, false)
+	if err != nil {
+		t.Fatalf("getCategorySites: %v", err)
+	}
+	if len(sites) != 0 {
+		t.Fatalf("got %d sites before save, want 0", len(sites))
+	}
+
+	site := &Site{Name: "child site", CategoryID: []string{child.Key}}
+	if _, err := site.save(c); err != nil {
+		t.Fatalf("site.save: %v", err)
+	}
+
+	sites, err = getCategorySites(c, parentKey, false)
+	if err != nil {
+		t.Fatalf("getCategorySites after invalidation: %v", err)
+	}
+	if len(sites) != 1 {
+		t.Fatalf("got %d sites in parent listing after child save, want 1 (ancestor cache not invalidated)", len(sites))
+	}
+}
@@ -0,0 +1,160 @@
+package cookieryapi
+
+//
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Category is a Kind "Category" entity, stored (like Site) under the
+// defaultSiteList ancestor. A Site references the categories it belongs to
+// by the category's encoded datastore key (see Category.Key and
+// Site.CategoryID), not by a raw integer id, so that keys round-trip
+// safely through JSON and URLs without clients needing to know about
+// Kinds or namespaces.
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+type Category struct {
+	Id       int64     `json:"id" datastore:"-"`
+	Key      string    `json:"key" datastore:"-"`
+	Name     string    `json:"name"`
+	ParentID string    `json:"parentId,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+func (t *Category) key(c appengine.Context) *datastore.Key {
+	if t.Id == 0 {
+		t.Created = time.Now()
+		return datastore.NewIncompleteKey(c, "Category", defaultSiteList(c))
+	}
+	return datastore.NewKey(c, "Category", "", t.Id, defaultSiteList(c))
+}
+
+func (t *Category) save(c appengine.Context) (*Category, error) {
+	k, err := datastore.Put(c, t.key(c), t)
+	if err != nil {
+		return nil, err
+	}
+	t.Id = k.IntID()
+	t.Key = k.Encode()
+	return t, nil
+}
+
+func (t *Category) delete(c appengine.Context) error {
+	return datastore.Delete(c, t.key(c))
+}
+
+func decodeCategory(r io.ReadCloser) (*Category, error) {
+	defer r.Close()
+	var cat Category
+	err := json.NewDecoder(r).Decode(&cat)
+	return &cat, err
+}
+
+func getAllCategories(c appengine.Context) ([]Category, error) {
+	cats := []Category{}
+	ks, err := datastore.NewQuery("Category").Ancestor(defaultSiteList(c)).Order("Created").GetAll(c, &cats)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(cats); i++ {
+		cats[i].Id = ks[i].IntID()
+		cats[i].Key = ks[i].Encode()
+	}
+	return cats, nil
+}
+
+// descendantCategoryKeys walks the Category tree rooted at key, following
+// ParentID references, and returns key plus every descendant's key.
+func descendantCategoryKeys(c appengine.Context, key *datastore.Key) ([]*datastore.Key, error) {
+	keys := []*datastore.Key{key}
+	var children []Category
+	childKeys, err := datastore.NewQuery("Category").Ancestor(defaultSiteList(c)).Filter("ParentID=", key.Encode()).GetAll(c, &children)
+	if err != nil {
+		return nil, err
+	}
+	for _, ck := range childKeys {
+		sub, err := descendantCategoryKeys(c, ck)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sub...)
+	}
+	return keys, nil
+}
+
+// ancestorCategoryKeys returns encoded plus the encoded key of every
+// ancestor reached by following ParentID up the tree. A site tagged only
+// with a child category contributes to every ancestor's aggregated
+// queryCategorySites listing, so invalidateSiteCaches needs this to bust
+// the parents' cache entries too, not just the site's own category.
+func ancestorCategoryKeys(c appengine.Context, encoded string) ([]string, error) {
+	keys := []string{encoded}
+	for encoded != "" {
+		key, err := datastore.DecodeKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		var cat Category
+		if err := datastore.Get(c, key, &cat); err != nil {
+			return nil, err
+		}
+		if cat.ParentID == "" {
+			break
+		}
+		keys = append(keys, cat.ParentID)
+		encoded = cat.ParentID
+	}
+	return keys, nil
+}
+
+// getCategorySites returns every Site tagged with key's category or any of
+// its descendant categories, served from memcache unless nocache is set.
+func getCategorySites(c appengine.Context, key *datastore.Key, nocache bool) ([]Site, error) {
+	return cachedSites(c, cacheKeyForCategory(key), nocache, func() ([]Site, error) {
+		return queryCategorySites(c, key)
+	})
+}
+
+func queryCategorySites(c appengine.Context, key *datastore.Key) ([]Site, error) {
+	keys, err := descendantCategoryKeys(c, key)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	sites := []Site{}
+	for _, k := range keys {
+		batch := []Site{}
+		ks, err := datastore.NewQuery("Site").Ancestor(defaultSiteList(c)).Filter("CategoryID=", k.Encode()).Order("Created").GetAll(c, &batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, sk := range ks {
+			if seen[sk.IntID()] {
+				continue
+			}
+			seen[sk.IntID()] = true
+			batch[i].Id = sk.IntID()
+			sites = append(sites, batch[i])
+		}
+	}
+	return sites, nil
+}
@@ -18,40 +18,25 @@ package cookieryapi
 
 // gosites is an App Engine JSON backend for managing a site list.
 //
-// It supports the following commands:
+// This file holds the Site entity and its datastore access; the HTTP
+// surface (routes, typed handlers, auth wiring) lives in router.go. See
+// that file's doc comment for the resource URLs.
 //
-// - Create a new site
-// POST /sites
-// > {"text": "do this"}
-// < {"id": 1, "text": "do this", "created": 1356724843.0, "done": false}
-//
-// - Update an existing site
-// POST /sites
-// > {"id": 1, "text": "do this", "created": 1356724843.0, "done": true}
-// < {"id": 1, "text": "do this", "created": 1356724843.0, "done": true}
-//
-// - List existing sites:
-// GET /sites
-// >
-// < [{"id": 1, "text": "do this", "created": 1356724843.0, "done": true},
-//    {"id": 2, "text": "do that", "created": 1356724849.0, "done": false}]
-//
-// - Delete 'done' sites:
-// DELETE /sites
-// >
-// <
+// POST, PUT, PATCH and DELETE require a signed-in Google user
+// (appengine/user); the acting user becomes the Site's Owner and only that
+// owner may mutate it afterwards. GET /v1/sites?mine=1 restricts the
+// listing to the caller's own sites.
 
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"time"
-  "strconv"
 
 	"appengine"
 	"appengine/datastore"
+	"appengine/user"
 )
 
 func defaultSiteList(c appengine.Context) *datastore.Key {
@@ -62,8 +47,12 @@ type Site struct {
 	Id   int64  `json:"id" datastore:"-"`
   Name string   `json:"name"`
 	URL string `json:"url" datastore:",noindex"`
+  // CategoryID holds the encoded datastore keys (Category.Key) of the
+  // categories this site belongs to.
   CategoryID []string `json:"categoryid"`
 	Created time.Time `json:"created"`
+	Owner string `json:"owner,omitempty"`
+	Done bool `json:"done"`
 }
 
 func (t *Site) key(c appengine.Context) *datastore.Key {
@@ -75,14 +64,55 @@ func (t *Site) key(c appengine.Context) *datastore.Key {
 }
 
 func (t *Site) save(c appengine.Context) (*Site, error) {
-	k, err := datastore.Put(c, t.key(c), t)
+	u := user.Current(c)
+	if u == nil {
+		return nil, &httpError{http.StatusUnauthorized, "login required"}
+	}
+	k := t.key(c)
+	var oldCategories []string
+	if t.Id != 0 {
+		var existing Site
+		if err := datastore.Get(c, k, &existing); err != nil {
+			return nil, err
+		}
+		if existing.Owner != "" && existing.Owner != u.Email {
+			return nil, &httpError{http.StatusForbidden, "forbidden: not the owner of this site"}
+		}
+		t.Owner = existing.Owner
+		t.Created = existing.Created
+		oldCategories = existing.CategoryID
+	} else {
+		t.Owner = u.Email
+	}
+	k, err := datastore.Put(c, k, t)
 	if err != nil {
 		return nil, err
 	}
 	t.Id = k.IntID()
+	invalidateSiteCaches(c, append(oldCategories, t.CategoryID...))
 	return t, nil
 }
 
+func (t *Site) delete(c appengine.Context) error {
+	u := user.Current(c)
+	if u == nil {
+		return &httpError{http.StatusUnauthorized, "login required"}
+	}
+	k := t.key(c)
+	var existing Site
+	if err := datastore.Get(c, k, &existing); err != nil {
+		return err
+	}
+	if existing.Owner != "" && existing.Owner != u.Email {
+		return &httpError{http.StatusForbidden, "forbidden: not the owner of this site"}
+	}
+	if err := datastore.Delete(c, k); err != nil {
+		return err
+	}
+	invalidateSiteCaches(c, existing.CategoryID)
+	return nil
+}
+
 func decodeSite(r io.ReadCloser) (*Site, error) {
 	defer r.Close()
 	var site Site
@@ -90,7 +120,22 @@ func decodeSite(r io.ReadCloser) (*Site, error) {
 	return &site, err
 }
 
-func getAllSites(c appengine.Context) ([]Site, error) {
+func getSite(c appengine.Context, id int64) (*Site, error) {
+	site := &Site{Id: id}
+	if err := datastore.Get(c, site.key(c), site); err != nil {
+		return nil, err
+	}
+	site.Id = id
+	return site, nil
+}
+
+func getAllSites(c appengine.Context, nocache bool) ([]Site, error) {
+	return cachedSites(c, cacheKeyAllSites, nocache, func() ([]Site, error) {
+		return queryAllSites(c)
+	})
+}
+
+func queryAllSites(c appengine.Context) ([]Site, error) {
 	sites := []Site{}
 	ks, err := datastore.NewQuery("Site").Ancestor(defaultSiteList(c)).Order("Created").GetAll(c, &sites)
 	if err != nil {
@@ -102,9 +147,9 @@ func getAllSites(c appengine.Context) ([]Site, error) {
 	return sites, nil
 }
 
-func getCategorySites(c appengine.Context, cat int) ([]Site, error) {
+func getMySites(c appengine.Context, owner string) ([]Site, error) {
 	sites := []Site{}
-	ks, err := datastore.NewQuery("Site").Ancestor(defaultSiteList(c)).Filter("CategoryID=", strconv.Itoa(cat)).Order("Created").GetAll(c, &sites)
+	ks, err := datastore.NewQuery("Site").Ancestor(defaultSiteList(c)).Filter("Owner=", owner).Order("Created").GetAll(c, &sites)
 	if err != nil {
 		return nil, err
 	}
@@ -115,39 +160,3 @@ func getCategorySites(c appengine.Context, cat int) ([]Site, error) {
 }
 
 
-func init() {
-	http.HandleFunc("/sites", handler)
-}
-
-func handler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	c := appengine.NewContext(r)
-	val, err := handleSites(c, r)
-	if err == nil {
-		err = json.NewEncoder(w).Encode(val)
-	}
-	if err != nil {
-		c.Errorf("site error: %#v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
-func handleSites(c appengine.Context, r *http.Request) (interface{}, error) {
-	switch r.Method {
-	case "POST":
-		site, err := decodeSite(r.Body)
-		if err != nil {
-			return nil, err
-		}
-		return site.save(c)
-	case "GET":
-    {
-      if cat, err := strconv.Atoi(r.URL.Query().Get("cat")); err == nil {
-        return getCategorySites(c, cat)
-      }
-      return getAllSites(c)
-    }
-	}
-	return nil, fmt.Errorf("method not implemented")
-}
@@ -0,0 +1,299 @@
+package cookieryapi
+
+//
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// This file wires up the chi-based router that replaced the old single
+// "/sites" http.HandleFunc dispatcher. It exposes versioned REST resources:
+//
+// - Create a site
+// POST /v1/sites
+// > {"name": "example.com", "url": "https://example.com"}
+// < {"id": 1, "name": "example.com", "url": "https://example.com", "created": ...}
+//
+// - Fetch / replace / delete a single site
+// GET    /v1/sites/{id}
+// PUT    /v1/sites/{id}
+// DELETE /v1/sites/{id}
+//
+// - Toggle a site's done flag
+// PATCH /v1/sites/{id}/done
+// > {"done": true}
+//
+// - List sites, optionally just the caller's own (?mine=1)
+// GET /v1/sites
+//
+// - Bulk create / delete, up to maxBatchSize sites per call
+// POST   /v1/sites:batchCreate
+// > [{"name": "a.com", "url": "https://a.com"}, {"name": "b.com", "url": "https://b.com"}]
+// < {"ids": [1, 2]}
+// DELETE /v1/sites:batchDelete
+// > {"ids": [1, 2]}
+// < {"deleted": [1, 2]}
+// ("errors", keyed by index into the request, is added when any entry fails.)
+//
+// - List the sites in a category (and its nested categories)
+// GET /v1/categories/{catID}/sites
+//
+// - Create, list and delete categories
+// POST   /v1/categories
+// GET    /v1/categories
+// DELETE /v1/categories/{id}
+//
+// catID/id path segments for categories are a Category's encoded datastore
+// key (Category.Key), produced by datastore.Key.Encode() and decoded back
+// with datastore.DecodeKey(); see category.go.
+//
+// POST, PUT, PATCH and DELETE require a signed-in user; see cookieryapi.go.
+//
+// GET /v1/sites and GET /v1/categories/{catID}/sites are served from
+// memcache; pass ?nocache=1 to bypass the cache for that request. See
+// cache.go.
+//
+// /v1/sites and /v1/categories/{catID}/sites load every matching site on
+// every call and return a bare JSON array. For large lists, use the
+// cursor-paginated /v2/sites and /v2/categories/{catID}/sites instead
+// (?limit=, ?cursor=), which return {"items": [...], "nextCursor": "..."}.
+// See pagination.go.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+
+	"github.com/go-chi/chi"
+)
+
+// apiHandler is the typed signature every route handler implements. It
+// works in terms of Go values and errors; render takes care of turning
+// that into an HTTP response.
+type apiHandler func(c appengine.Context, r *http.Request) (interface{}, error)
+
+// httpError lets an apiHandler pick its own status code; render falls back
+// to 500 for any other error, matching the old dispatcher's behavior.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func render(f apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		c := appengine.NewContext(r)
+		val, err := f(c, r)
+		if err != nil {
+			c.Errorf("site error: %#v", err)
+			status := http.StatusInternalServerError
+			if he, ok := err.(*httpError); ok {
+				status = he.status
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		json.NewEncoder(w).Encode(val)
+	}
+}
+
+// requireAuth rejects the request with 401 before f runs unless a Google
+// user is signed in. Site.save and Site.delete separately enforce that the
+// signed-in user actually owns the site being mutated.
+func requireAuth(f apiHandler) apiHandler {
+	return func(c appengine.Context, r *http.Request) (interface{}, error) {
+		if user.Current(c) == nil {
+			return nil, &httpError{http.StatusUnauthorized, "login required"}
+		}
+		return f(c, r)
+	}
+}
+
+func init() {
+	r := chi.NewRouter()
+
+	r.Get("/v1/sites", render(listSites))
+	r.Post("/v1/sites", render(requireAuth(createSite)))
+	r.Post("/v1/sites:batchCreate", render(requireAuth(batchCreateSitesHandler)))
+	r.Delete("/v1/sites:batchDelete", render(requireAuth(batchDeleteSitesHandler)))
+
+	r.Get("/v1/sites/{id}", render(getSiteByID))
+	r.Put("/v1/sites/{id}", render(requireAuth(updateSite)))
+	r.Delete("/v1/sites/{id}", render(requireAuth(deleteSite)))
+	r.Patch("/v1/sites/{id}/done", render(requireAuth(setSiteDone)))
+
+	r.Get("/v1/categories/{catID}/sites", render(listCategorySites))
+
+	r.Get("/v1/categories", render(listCategories))
+	r.Post("/v1/categories", render(requireAuth(createCategory)))
+	r.Delete("/v1/categories/{id}", render(requireAuth(deleteCategory)))
+
+	r.Get("/v2/sites", render(listSitesV2))
+	r.Get("/v2/categories/{catID}/sites", render(listCategorySitesV2))
+
+	http.Handle("/v1/", r)
+	http.Handle("/v2/", r)
+}
+
+func parseID(r *http.Request) (int64, error) {
+	return strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+}
+
+func listSites(c appengine.Context, r *http.Request) (interface{}, error) {
+	if r.URL.Query().Get("mine") == "1" {
+		u := user.Current(c)
+		if u == nil {
+			return nil, &httpError{http.StatusUnauthorized, "login required"}
+		}
+		return getMySites(c, u.Email)
+	}
+	return getAllSites(c, r.URL.Query().Get("nocache") == "1")
+}
+
+func createSite(c appengine.Context, r *http.Request) (interface{}, error) {
+	site, err := decodeSite(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	site.Id = 0
+	return site.save(c)
+}
+
+func getSiteByID(c appengine.Context, r *http.Request) (interface{}, error) {
+	id, err := parseID(r)
+	if err != nil {
+		return nil, err
+	}
+	return getSite(c, id)
+}
+
+func updateSite(c appengine.Context, r *http.Request) (interface{}, error) {
+	id, err := parseID(r)
+	if err != nil {
+		return nil, err
+	}
+	site, err := decodeSite(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	site.Id = id
+	return site.save(c)
+}
+
+func deleteSite(c appengine.Context, r *http.Request) (interface{}, error) {
+	id, err := parseID(r)
+	if err != nil {
+		return nil, err
+	}
+	site := &Site{Id: id}
+	if err := site.delete(c); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func setSiteDone(c appengine.Context, r *http.Request) (interface{}, error) {
+	id, err := parseID(r)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Done bool `json:"done"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	site, err := getSite(c, id)
+	if err != nil {
+		return nil, err
+	}
+	site.Done = body.Done
+	return site.save(c)
+}
+
+func listCategorySites(c appengine.Context, r *http.Request) (interface{}, error) {
+	key, err := datastore.DecodeKey(chi.URLParam(r, "catID"))
+	if err != nil {
+		return nil, err
+	}
+	return getCategorySites(c, key, r.URL.Query().Get("nocache") == "1")
+}
+
+func listCategories(c appengine.Context, r *http.Request) (interface{}, error) {
+	return getAllCategories(c)
+}
+
+func createCategory(c appengine.Context, r *http.Request) (interface{}, error) {
+	cat, err := decodeCategory(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	cat.Id = 0
+	return cat.save(c)
+}
+
+func batchCreateSitesHandler(c appengine.Context, r *http.Request) (interface{}, error) {
+	var sites []Site
+	if err := json.NewDecoder(r.Body).Decode(&sites); err != nil {
+		return nil, err
+	}
+	if len(sites) > maxBatchSize {
+		return nil, &httpError{http.StatusBadRequest, "batch exceeds the 500 site limit"}
+	}
+	ids, errs, err := batchCreateSites(c, sites, user.Current(c).Email)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Ids    []int64        `json:"ids"`
+		Errors map[int]string `json:"errors,omitempty"`
+	}{ids, errs}, nil
+}
+
+func batchDeleteSitesHandler(c appengine.Context, r *http.Request) (interface{}, error) {
+	var body struct {
+		Ids []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if len(body.Ids) > maxBatchSize {
+		return nil, &httpError{http.StatusBadRequest, "batch exceeds the 500 site limit"}
+	}
+	deleted, errs, err := batchDeleteSites(c, body.Ids, user.Current(c).Email)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Deleted []int64        `json:"deleted"`
+		Errors  map[int]string `json:"errors,omitempty"`
+	}{deleted, errs}, nil
+}
+
+func deleteCategory(c appengine.Context, r *http.Request) (interface{}, error) {
+	key, err := datastore.DecodeKey(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, err
+	}
+	cat := &Category{Id: key.IntID()}
+	if err := cat.delete(c); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}